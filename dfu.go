@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gousb"
+)
+
+const (
+	dfuVID = 0x0483
+	dfuPID = 0xdf11
+
+	// DFU class requests (DFU 1.1, section 3).
+	dfuReqDetach    = 0
+	dfuReqDnload    = 1
+	dfuReqUpload    = 2
+	dfuReqGetStatus = 3
+	dfuReqClrStatus = 4
+	dfuReqGetState  = 5
+	dfuReqAbort     = 6
+
+	// bmRequestType for the DFU class requests: class, interface
+	// recipient, host-to-device or device-to-host.
+	dfuRequestTypeOut = 0x21
+	dfuRequestTypeIn  = 0xa1
+
+	// DfuSe vendor commands, sent as the first bytes of a DNLOAD to
+	// block 0 (see AN3156).
+	dfuSeSetAddressPointer = 0x21
+	dfuSeErase             = 0x41
+
+	// DfuSe status/state values we care about.
+	dfuStateDfuDnloadIdle = 5
+	dfuStateDfuManifest   = 7
+	dfuStatusOK           = 0
+
+	dfuBlockSize = 2048
+)
+
+// dfuPage describes one flash page of a DfuSe interface. Each entry of
+// the alt-setting string expands into several of them, e.g. the
+// "04*016Kg" in "@Internal Flash  /0x08000000/04*016Kg,01*064Kg,07*128Kg"
+// describes four 16KB pages.
+type dfuPage struct {
+	Address uint32
+	Size    uint32
+}
+
+// DFUDevice is a single DfuSe-capable alt-setting found on the bus,
+// already carrying everything needed to erase and flash it.
+type DFUDevice struct {
+	Serial      string
+	Alt         int
+	BaseAddress uint32
+	Pages       []dfuPage
+}
+
+// DFU talks DfuSe to a board in bootloader mode. FC.newProgrammer gets
+// one from newDFU, which picks whichever implementation is available.
+type DFU interface {
+	// Devices returns the DfuSe-capable devices currently attached.
+	Devices() ([]DFUDevice, error)
+	// WaitForDevice polls Devices until one shows up or timeout elapses.
+	WaitForDevice(timeout time.Duration) (DFUDevice, error)
+	// Erase erases the pages of dev overlapping fw, or the whole chip
+	// if fw is nil.
+	Erase(dev DFUDevice, fw []byte) error
+	// Write streams fw to dev starting at dev.BaseAddress, reporting
+	// progress in bytes. The target range must already be erased.
+	Write(dev DFUDevice, fw []byte, progress func(done, total int)) error
+	// Leave exits DFU mode so the board runs the application it just
+	// received.
+	Leave(dev DFUDevice) error
+	Close() error
+}
+
+// newDFU returns the best available DFU implementation: a native
+// libusb backend if libusb is present on the system, falling back to
+// shelling out to dfu-util otherwise. stdout receives the fallback's
+// subprocess output.
+func newDFU(stdout io.Writer) (DFU, error) {
+	if dfu, err := newLibusbDFU(); err == nil {
+		return dfu, nil
+	}
+	return newDfuUtilDFU(stdout)
+}
+
+// waitForDevice polls d.Devices() until one is found or timeout elapses.
+// It's shared by both DFU implementations.
+func waitForDevice(d DFU, timeout time.Duration) (DFUDevice, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		devices, err := d.Devices()
+		if err != nil {
+			return DFUDevice{}, err
+		}
+		if len(devices) > 0 {
+			return devices[0], nil
+		}
+		if time.Now().After(deadline) {
+			return DFUDevice{}, fmt.Errorf("timed out while waiting for board in DFU mode")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// dfuSectorMapRe matches one run-length-encoded sector entry, e.g.
+// "04*016Kg" (4 sectors of 16KB, erasable/"g" = readable+erasable+writable).
+var dfuSectorMapRe = regexp.MustCompile(`(\d+)\*(\d+)([BKM])(.)`)
+
+// parseDfuSectorMap parses a DfuSe alt-setting descriptor string, e.g.
+// "@Internal Flash  /0x08000000/04*016Kg,01*064Kg,07*128Kg", into the
+// base address and the list of individual pages it describes.
+func parseDfuSectorMap(desc string) (uint32, []dfuPage, error) {
+	parts := strings.Split(desc, "/")
+	if len(parts) < 3 {
+		return 0, nil, fmt.Errorf("malformed DfuSe descriptor %q", desc)
+	}
+	base, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 0, 32)
+	if err != nil {
+		return 0, nil, fmt.Errorf("malformed DfuSe base address in %q: %v", desc, err)
+	}
+	var pages []dfuPage
+	addr := uint32(base)
+	for _, entry := range strings.Split(parts[2], ",") {
+		m := dfuSectorMapRe.FindStringSubmatch(strings.TrimSpace(entry))
+		if m == nil {
+			return 0, nil, fmt.Errorf("malformed DfuSe sector entry %q", entry)
+		}
+		count, _ := strconv.Atoi(m[1])
+		size, _ := strconv.Atoi(m[2])
+		switch m[3] {
+		case "K":
+			size *= 1024
+		case "M":
+			size *= 1024 * 1024
+		}
+		for ii := 0; ii < count; ii++ {
+			pages = append(pages, dfuPage{Address: addr, Size: uint32(size)})
+			addr += uint32(size)
+		}
+	}
+	return uint32(base), pages, nil
+}
+
+// dfuStatus is the response to DFU_GETSTATUS (DFU 1.1, section 6.1.2).
+type dfuStatus struct {
+	Status      byte
+	PollTimeout time.Duration
+	State       byte
+}
+
+func parseDfuStatus(b []byte) dfuStatus {
+	ms := uint32(b[1]) | uint32(b[2])<<8 | uint32(b[3])<<16
+	return dfuStatus{
+		Status:      b[0],
+		PollTimeout: time.Duration(ms) * time.Millisecond,
+		State:       b[4],
+	}
+}
+
+// libusbDFU implements DFU natively on top of gousb, without requiring
+// dfu-util to be installed.
+type libusbDFU struct {
+	ctx *gousb.Context
+}
+
+func newLibusbDFU() (*libusbDFU, error) {
+	ctx := gousb.NewContext()
+	// gousb.NewContext() never fails on its own, even when libusb itself
+	// isn't usable (missing shared library, no permission to open the
+	// bus, ...), so probe it with an actual enumeration before trusting
+	// it. This is also what makes newDFU's dfu-util fallback reachable.
+	if _, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool { return false }); err != nil {
+		ctx.Close()
+		return nil, fmt.Errorf("libusb isn't usable: %w", err)
+	}
+	return &libusbDFU{ctx: ctx}, nil
+}
+
+func (d *libusbDFU) Close() error {
+	return d.ctx.Close()
+}
+
+func (d *libusbDFU) WaitForDevice(timeout time.Duration) (DFUDevice, error) {
+	return waitForDevice(d, timeout)
+}
+
+func (d *libusbDFU) openDevices() ([]*gousb.Device, error) {
+	return d.ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		return desc.Vendor == gousb.ID(dfuVID) && desc.Product == gousb.ID(dfuPID)
+	})
+}
+
+func (d *libusbDFU) Devices() ([]DFUDevice, error) {
+	devs, err := d.openDevices()
+	if err != nil {
+		return nil, err
+	}
+	var result []DFUDevice
+	for _, dev := range devs {
+		serial, _ := dev.SerialNumber()
+		altStrings, err := altInterfaceStrings(dev)
+		if err != nil {
+			dev.Close()
+			continue
+		}
+		for alt, idx := range altStrings {
+			name, err := dev.GetStringDescriptor(idx)
+			if err != nil || !strings.HasPrefix(name, internalFlashMarker) {
+				continue
+			}
+			base, pages, err := parseDfuSectorMap(name)
+			if err != nil {
+				continue
+			}
+			result = append(result, DFUDevice{
+				Serial:      serial,
+				Alt:         alt,
+				BaseAddress: base,
+				Pages:       pages,
+			})
+		}
+		dev.Close()
+	}
+	return result, nil
+}
+
+// altInterfaceStrings walks the raw configuration descriptor of dev and
+// returns the iInterface string descriptor index for every alt setting,
+// keyed by bAlternateSetting. gousb doesn't parse iInterface itself, so
+// we fetch the descriptor bytes with a standard GET_DESCRIPTOR request
+// and pick out the interface descriptors by hand.
+func altInterfaceStrings(dev *gousb.Device) (map[int]int, error) {
+	const (
+		reqGetDescriptor  = 0x06
+		descTypeConfig    = 0x02
+		descTypeInterface = 0x04
+	)
+	// 255 bytes, the 9-byte config descriptor header included, is
+	// enough for every DfuSe bootloader config seen in the wild.
+	buf := make([]byte, 255)
+	n, err := dev.Control(0x80, reqGetDescriptor, descTypeConfig<<8, 0, buf)
+	if err != nil {
+		return nil, err
+	}
+	buf = buf[:n]
+	result := make(map[int]int)
+	for off := 0; off+1 < len(buf); {
+		length := int(buf[off])
+		if length == 0 || off+length > len(buf) {
+			break
+		}
+		if buf[off+1] == descTypeInterface && length >= 9 {
+			alt := int(buf[off+3])
+			iInterface := int(buf[off+8])
+			if iInterface != 0 {
+				result[alt] = iInterface
+			}
+		}
+		off += length
+	}
+	return result, nil
+}
+
+func (d *libusbDFU) control(dev *gousb.Device, reqType uint8, request uint8, value uint16, iface int, data []byte) (int, error) {
+	return dev.Control(reqType, request, value, uint16(iface), data)
+}
+
+func (d *libusbDFU) getStatus(dev *gousb.Device, iface int) (dfuStatus, error) {
+	buf := make([]byte, 6)
+	if _, err := d.control(dev, dfuRequestTypeIn, dfuReqGetStatus, 0, iface, buf); err != nil {
+		return dfuStatus{}, err
+	}
+	st := parseDfuStatus(buf)
+	if st.PollTimeout > 0 {
+		time.Sleep(st.PollTimeout)
+	}
+	return st, nil
+}
+
+func (d *libusbDFU) clrStatus(dev *gousb.Device, iface int) error {
+	_, err := d.control(dev, dfuRequestTypeOut, dfuReqClrStatus, 0, iface, nil)
+	return err
+}
+
+func (d *libusbDFU) dnload(dev *gousb.Device, iface int, blockNum int, data []byte) error {
+	if _, err := d.control(dev, dfuRequestTypeOut, dfuReqDnload, uint16(blockNum), iface, data); err != nil {
+		return err
+	}
+	st, err := d.getStatus(dev, iface)
+	if err != nil {
+		return err
+	}
+	if st.Status != dfuStatusOK {
+		return fmt.Errorf("DFU error, status %d in state %d", st.Status, st.State)
+	}
+	return nil
+}
+
+func (d *libusbDFU) setAddressPointer(dev *gousb.Device, iface int, addr uint32) error {
+	buf := make([]byte, 5)
+	buf[0] = dfuSeSetAddressPointer
+	binary.LittleEndian.PutUint32(buf[1:], addr)
+	return d.dnload(dev, iface, 0, buf)
+}
+
+func (d *libusbDFU) erasePage(dev *gousb.Device, iface int, addr uint32) error {
+	buf := make([]byte, 5)
+	buf[0] = dfuSeErase
+	binary.LittleEndian.PutUint32(buf[1:], addr)
+	return d.dnload(dev, iface, 0, buf)
+}
+
+// findDevice re-opens the bus device matching dfuDev's serial number.
+// Callers must Close() the result.
+func (d *libusbDFU) findDevice(dfuDev DFUDevice) (*gousb.Device, error) {
+	devs, err := d.openDevices()
+	if err != nil {
+		return nil, err
+	}
+	var found *gousb.Device
+	for _, cand := range devs {
+		serial, _ := cand.SerialNumber()
+		if serial == dfuDev.Serial && found == nil {
+			found = cand
+			continue
+		}
+		cand.Close()
+	}
+	if found == nil {
+		return nil, fmt.Errorf("DFU device with serial %q not found", dfuDev.Serial)
+	}
+	return found, nil
+}
+
+func (d *libusbDFU) Erase(dfuDev DFUDevice, fw []byte) error {
+	dev, err := d.findDevice(dfuDev)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	iface := dfuDev.Alt
+	if fw == nil {
+		// Mass erase: the DfuSe ERASE command with no trailing address.
+		return d.dnload(dev, iface, 0, []byte{dfuSeErase})
+	}
+	for _, page := range dfuDev.Pages {
+		if page.Address+page.Size <= dfuDev.BaseAddress || page.Address >= dfuDev.BaseAddress+uint32(len(fw)) {
+			continue
+		}
+		if err := d.erasePage(dev, iface, page.Address); err != nil {
+			return fmt.Errorf("erasing page at 0x%08x: %w", page.Address, err)
+		}
+	}
+	return nil
+}
+
+func (d *libusbDFU) Write(dfuDev DFUDevice, fw []byte, progress func(done, total int)) error {
+	dev, err := d.findDevice(dfuDev)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	iface := dfuDev.Alt
+	if err := d.setAddressPointer(dev, iface, dfuDev.BaseAddress); err != nil {
+		return fmt.Errorf("setting address pointer: %w", err)
+	}
+	total := len(fw)
+	done := 0
+	for done < total {
+		end := done + dfuBlockSize
+		if end > total {
+			end = total
+		}
+		// Block numbers 0 and 1 are reserved for DfuSe commands, so
+		// data blocks start at 2.
+		blockNum := 2 + done/dfuBlockSize
+		if err := d.dnload(dev, iface, blockNum, fw[done:end]); err != nil {
+			return fmt.Errorf("writing block %d: %w", blockNum, err)
+		}
+		done = end
+		if progress != nil {
+			progress(done, total)
+		}
+	}
+	return nil
+}
+
+func (d *libusbDFU) Leave(dfuDev DFUDevice) error {
+	dev, err := d.findDevice(dfuDev)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	iface := dfuDev.Alt
+	// A zero-length DNLOAD followed by GETSTATUS moves the device into
+	// dfuMANIFEST, after which it resets and runs the application.
+	if _, err := d.control(dev, dfuRequestTypeOut, dfuReqDnload, 0, iface, nil); err != nil {
+		return fmt.Errorf("leaving DFU mode: %w", err)
+	}
+	if _, err := d.getStatus(dev, iface); err != nil {
+		// The device may disconnect before replying once it resets
+		// into the application, which is expected.
+		return nil
+	}
+	return nil
+}
+
+// dfuUtilDFU implements DFU by shelling out to the dfu-util binary. It
+// is the fallback used when libusb isn't available.
+type dfuUtilDFU struct {
+	path   string
+	stdout io.Writer
+}
+
+func newDfuUtilDFU(stdout io.Writer) (*dfuUtilDFU, error) {
+	path, err := exec.LookPath("dfu-util")
+	if err != nil {
+		return nil, err
+	}
+	return &dfuUtilDFU{path: path, stdout: stdout}, nil
+}
+
+func (d *dfuUtilDFU) Close() error {
+	return nil
+}
+
+func (d *dfuUtilDFU) WaitForDevice(timeout time.Duration) (DFUDevice, error) {
+	return waitForDevice(d, timeout)
+}
+
+func (d *dfuUtilDFU) list() ([]string, error) {
+	cmd := exec.Command(d.path, "--list")
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	cmd.Run()
+	lines := strings.Split(buf.String(), "\n")
+	var dfuLines []string
+	for _, ll := range lines {
+		ll = strings.Trim(ll, "\n\r\t ")
+		if strings.HasPrefix(ll, dfuDevicePrefix) {
+			dfuLines = append(dfuLines, ll[len(dfuDevicePrefix):])
+		}
+	}
+	return dfuLines, nil
+}
+
+func (d *dfuUtilDFU) Devices() ([]DFUDevice, error) {
+	lines, err := d.list()
+	if err != nil {
+		return nil, err
+	}
+	var devices []DFUDevice
+	for _, line := range lines {
+		if !strings.Contains(line, internalFlashMarker) {
+			continue
+		}
+		altStr := regexpFind(`alt=(\d+)`, line)
+		serial := regexpFind(`serial="(.*?)"`, line)
+		name := regexpFind(`name="(.*?)"`, line)
+		alt, _ := strconv.Atoi(altStr)
+		base, pages, err := parseDfuSectorMap(name)
+		if err != nil || serial == "" {
+			continue
+		}
+		devices = append(devices, DFUDevice{Serial: serial, Alt: alt, BaseAddress: base, Pages: pages})
+	}
+	return devices, nil
+}
+
+// run shells out to dfu-util with fw (which may be empty, e.g. for a
+// leave-only invocation) written at offset, with modifier appended to
+// -s (e.g. "mass-erase" or "leave").
+func (d *dfuUtilDFU) run(dev DFUDevice, fw []byte, modifier string) error {
+	tmp, err := ioutil.TempFile("", "msp-tool-*.bin")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(fw); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	offset := fmt.Sprintf("0x%08x", dev.BaseAddress)
+	sOpt := offset
+	if modifier != "" {
+		sOpt += ":" + modifier
+	}
+	cmd := exec.Command(d.path, "-a", strconv.Itoa(dev.Alt), "-S", dev.Serial, "-s", sOpt, "-D", tmp.Name())
+	cmd.Stdout = d.stdout
+	cmd.Stderr = d.stdout
+	return cmd.Run()
+}
+
+func (d *dfuUtilDFU) Erase(dev DFUDevice, fw []byte) error {
+	// dfu-util only exposes a whole-chip mass erase, not per-page
+	// erase, so that's what we do regardless of fw.
+	return d.run(dev, nil, "mass-erase")
+}
+
+func (d *dfuUtilDFU) Write(dev DFUDevice, fw []byte, progress func(done, total int)) error {
+	if err := d.run(dev, fw, ""); err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(len(fw), len(fw))
+	}
+	return nil
+}
+
+func (d *dfuUtilDFU) Leave(dev DFUDevice) error {
+	return d.run(dev, nil, "leave")
+}
+
+// regexpFind returns the first capture group of pattern in s, or the
+// empty string if there's no match.
+func regexpFind(pattern string, s string) string {
+	r := regexp.MustCompile(pattern)
+	m := r.FindStringSubmatch(s)
+	if len(m) > 1 {
+		return m[1]
+	}
+	return ""
+}
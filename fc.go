@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -9,8 +9,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,15 +24,45 @@ const (
 // handle disconnections and reconnections on its on. Use NewFC()
 // to initialize an FC and then call FC.StartUpdating().
 type FC struct {
-	opts         FCOptions
-	msp          *MSP
-	variant      string
-	versionMajor byte
-	versionMinor byte
-	versionPatch byte
-	boardID      string
-	targetName   string
-	features     uint32
+	opts FCOptions
+	msp  *MSP
+	// closing is set by StopUpdating to tell StartUpdating's reader
+	// goroutine to return on the next read error instead of reconnecting.
+	closing         int32
+	variant         string
+	apiVersionMajor byte
+	apiVersionMinor byte
+	protocolVersion byte
+	versionMajor    byte
+	versionMinor    byte
+	versionPatch    byte
+	boardID         string
+	targetName      string
+	buildDate       string
+	buildTime       string
+	buildRev        string
+	features        uint32
+	serialConfigs   []MSPSerialConfig
+
+	// Fields below are only populated on request, by BoardStatus(), and
+	// are written from the StartUpdating goroutine's handleFrame but
+	// read from whatever goroutine calls BoardStatus, so statusMu
+	// guards all of them including statusPending and statusDone.
+	statusMu sync.Mutex
+	// statusPending tracks which of the extra queries BoardStatus sent
+	// are still outstanding; statusDone is closed once it's empty.
+	statusPending map[byte]bool
+	statusDone    chan struct{}
+	name          string
+	statusEx      statusExInfo
+	motorConfig   motorConfigInfo
+	pids          []pidInfo
+	rxConfig      rxConfigInfo
+	vtxConfig     vtxConfigInfo
+	batteryConfig batteryConfigInfo
+	boxNames      []string
+	boxIDs        []byte
+	osdConfig     []byte
 }
 
 type FCOptions struct {
@@ -39,6 +70,10 @@ type FCOptions struct {
 	BaudRate         int
 	Stdout           io.Writer
 	EnableDebugTrace bool
+	// Programmer forces the flashing backend ("dfu", "stm32flash" or
+	// "bossac") instead of letting Flash pick one from the detected
+	// variant/targetName.
+	Programmer string
 }
 
 func (f *FCOptions) stderr() io.Writer {
@@ -109,7 +144,10 @@ func (f *FC) printInfo() {
 func (f *FC) handleFrame(fr *MSPFrame) {
 	switch fr.Code {
 	case mspAPIVersion:
-		f.printf("MSP API version %d.%d (protocol %d)\n", fr.Byte(1), fr.Byte(2), fr.Byte(0))
+		f.protocolVersion = fr.Byte(0)
+		f.apiVersionMajor = fr.Byte(1)
+		f.apiVersionMinor = fr.Byte(2)
+		f.printf("MSP API version %d.%d (protocol %d)\n", f.apiVersionMajor, f.apiVersionMinor, f.protocolVersion)
 	case mspFCVariant:
 		f.variant = string(fr.Payload)
 		f.printInfo()
@@ -133,11 +171,11 @@ func (f *FC) handleFrame(fr *MSPFrame) {
 		}
 		f.printInfo()
 	case mspBuildInfo:
-		buildDate := string(fr.Payload[:11])
-		buildTime := string(fr.Payload[11:19])
+		f.buildDate = string(fr.Payload[:11])
+		f.buildTime = string(fr.Payload[11:19])
 		// XXX: Revision is 8 characters in iNav but 7 in BF/CF
-		rev := string(fr.Payload[19:])
-		f.printf("Build %s (built on %s @ %s)\n", rev, buildDate, buildTime)
+		f.buildRev = string(fr.Payload[19:])
+		f.printf("Build %s (built on %s @ %s)\n", f.buildRev, f.buildDate, f.buildTime)
 	case mspFeature:
 		fr.Read(&f.features)
 		if (f.features&mspFCFeatureDebugTrace == 0) && f.shouldEnableDebugTrace() {
@@ -147,39 +185,41 @@ func (f *FC) handleFrame(fr *MSPFrame) {
 			f.msp.WriteCmd(mspEepromWrite)
 		}
 	case mspCFSerialConfig:
-		if f.shouldEnableDebugTrace() {
-			var cfg MSPSerialConfig
-			var serialConfigs []MSPSerialConfig
-			hasDebugTraceMSPPort := false
-			mask := uint16(serialFunctionMSP | serialFunctionDebugTrace)
-			for {
-				err := fr.Read(&cfg)
-				if err != nil {
-					if err == io.EOF {
-						// All ports read
-						break
-					}
-					panic(err)
-				}
-				if cfg.FunctionMask&mask == mask {
-					hasDebugTraceMSPPort = true
+		var cfg MSPSerialConfig
+		var serialConfigs []MSPSerialConfig
+		hasDebugTraceMSPPort := false
+		mask := uint16(serialFunctionMSP | serialFunctionDebugTrace)
+		for {
+			err := fr.Read(&cfg)
+			if err != nil {
+				if err == io.EOF {
+					// All ports read
+					break
 				}
-				serialConfigs = append(serialConfigs, cfg)
+				panic(err)
+			}
+			if cfg.FunctionMask&mask == mask {
+				hasDebugTraceMSPPort = true
 			}
-			if !hasDebugTraceMSPPort {
-				// Enable DEBUG_TRACE on the first MSP port, since DEBUG_TRACE only
-				// works on one port.
-				for ii := range serialConfigs {
-					if serialConfigs[ii].FunctionMask&serialFunctionMSP != 0 {
-						f.printf("Enabling FUNCTION_DEBUG_TRACE on serial port %v\n", serialConfigs[ii].Identifier)
-						serialConfigs[ii].FunctionMask |= serialFunctionDebugTrace
-						break
-					}
+			serialConfigs = append(serialConfigs, cfg)
+		}
+		f.statusMu.Lock()
+		f.serialConfigs = serialConfigs
+		f.statusMu.Unlock()
+		f.markStatusReceived(mspCFSerialConfig)
+		if f.shouldEnableDebugTrace() && !hasDebugTraceMSPPort {
+			// Enable DEBUG_TRACE on the first MSP port, since DEBUG_TRACE only
+			// works on one port.
+			for ii := range serialConfigs {
+				if serialConfigs[ii].FunctionMask&serialFunctionMSP != 0 {
+					f.printf("Enabling FUNCTION_DEBUG_TRACE on serial port %v\n", serialConfigs[ii].Identifier)
+					serialConfigs[ii].FunctionMask |= serialFunctionDebugTrace
+					break
 				}
-				// Save ports
-				f.msp.WriteCmd(mspSetCFSerialConfig, serialConfigs)
-				f.msp.WriteCmd(mspEepromWrite)
 			}
+			// Save ports
+			f.msp.WriteCmd(mspSetCFSerialConfig, serialConfigs)
+			f.msp.WriteCmd(mspEepromWrite)
 		}
 	case mspReboot:
 		f.printf("Rebooting board...\n")
@@ -190,6 +230,10 @@ func (f *FC) handleFrame(fr *MSPFrame) {
 	case mspSetCFSerialConfig:
 	case mspEepromWrite:
 		// Nothing to do for these
+	case mspName, mspStatusEx, mspMotorConfig, mspPid, mspRxConfig, mspVtxConfig, mspBatteryConfig, mspBoxNames, mspBoxIDs, mspOsdConfig:
+		// These are only requested by BoardStatus(); handleStatusFrame
+		// decodes them and tracks what BoardStatus is still waiting for.
+		f.handleStatusFrame(fr)
 	default:
 		f.printf("Unhandled MSP frame %d with payload %v\n", fr.Code, fr.Payload)
 	}
@@ -211,12 +255,16 @@ func (f *FC) Reboot() {
 }
 
 // StartUpdating starts reading from the MSP port and handling
-// the received messages. Note that it never returns.
+// the received messages. It returns once StopUpdating has been called;
+// otherwise it never returns.
 func (f *FC) StartUpdating() {
 	for {
 		frame, err := f.msp.ReadFrame()
 		if err != nil {
 			if err == io.EOF {
+				if atomic.LoadInt32(&f.closing) != 0 {
+					return
+				}
 				f.printf("Board disconnected, trying to reconnect...\n")
 				if err := f.reconnect(); err != nil {
 					panic(err)
@@ -233,6 +281,20 @@ func (f *FC) StartUpdating() {
 	}
 }
 
+// StopUpdating closes the MSP connection and tells StartUpdating's
+// reader goroutine to return instead of trying to reconnect. Flash
+// calls this before handing f.opts.PortName to a Programmer: a
+// serial-based one (stm32flashProgrammer) reopens the same UART, and a
+// reader goroutine still blocked on it would race the programmer for
+// the bootloader's ACK/NACK bytes.
+func (f *FC) StopUpdating() error {
+	atomic.StoreInt32(&f.closing, 1)
+	if f.msp == nil {
+		return nil
+	}
+	return f.msp.Close()
+}
+
 // HasDetectedTargetName returns true iff the target name installed on
 // the board has been retrieved via MSP.
 func (f *FC) HasDetectedTargetName() bool {
@@ -248,11 +310,6 @@ func (f *FC) Flash(srcDir string, targetName string) error {
 			return errors.New("empty target name")
 		}
 	}
-	// First, check that dfu-util is available
-	dfu, err := exec.LookPath("dfu-util")
-	if err != nil {
-		return err
-	}
 	// Now compile the target
 	cmd := exec.Command("make", "binary")
 	cmd.Stdout = f.opts.Stdout
@@ -296,95 +353,57 @@ func (f *FC) Flash(srcDir string, targetName string) error {
 	}
 
 	binaryPath := filepath.Join(obj, binary.Name())
-
-	f.printf("Rebooting board in DFU mode...\n")
-
-	// Now reboot in dfu mode
-	if err := f.dfuReboot(); err != nil {
+	firmware, err := LoadFirmware(binaryPath)
+	if err != nil {
 		return err
 	}
-	if err := f.dfuWait(dfu); err != nil {
-		return err
+	if !firmware.HasManifest {
+		f.printf("warning: no manifest at %s, flashing %s unverified\n", binaryPath+manifestSuffix, binaryPath)
 	}
-	return f.dfuFlash(dfu, binaryPath)
-}
-
-// Reboots the board into the bootloader for flashing
-func (f *FC) dfuReboot() error {
-	_, err := f.msp.RebootIntoBootloader()
-	return err
-}
-
-func (f *FC) dfuList(dfuPath string) ([]string, error) {
-	cmd := exec.Command(dfuPath, "--list")
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	cmd.Run()
-	lines := strings.Split(buf.String(), "\n")
-	var dfuLines []string
-	for _, ll := range lines {
-		ll = strings.Trim(ll, "\n\r\t ")
-		if strings.HasPrefix(ll, dfuDevicePrefix) {
-			dfuLines = append(dfuLines, ll[len(dfuDevicePrefix):])
-		}
+	if err := firmware.Verify(); err != nil {
+		return fmt.Errorf("firmware verification failed: %w", err)
 	}
-	return dfuLines, nil
-}
-
-func (f *FC) dfuWait(dfuPath string) error {
-	timeout := time.Now().Add(30 * time.Second)
-	for {
-		if timeout.Before(time.Now()) {
-			return fmt.Errorf("timed out while waiting for board in DFU mode")
-		}
-		devices, err := f.dfuList(dfuPath)
-		if err != nil {
-			return err
-		}
-		for _, dev := range devices {
-			if strings.Contains(dev, internalFlashMarker) {
-				// Found a flash device
-				return nil
-			}
-		}
+	if err := firmware.MatchesBoard(f); err != nil {
+		return fmt.Errorf("firmware doesn't match board: %w", err)
 	}
-}
 
-func (f *FC) regexpFind(pattern string, s string) string {
-	r := regexp.MustCompile(pattern)
-	m := r.FindStringSubmatch(s)
-	if len(m) > 1 {
-		return m[1]
+	prog, err := f.newProgrammer()
+	if err != nil {
+		return err
 	}
-	return ""
-}
 
-func (f *FC) dfuFlash(dfuPath string, binaryPath string) error {
-	devices, err := f.dfuList(dfuPath)
+	f.printf("Rebooting board into the bootloader...\n")
+
+	// Now reboot into the bootloader
+	if err := f.rebootIntoBootloader(); err != nil {
+		return err
+	}
+	// Close the MSP connection and stop its reader goroutine before the
+	// Programmer takes over: a serial-based one reopens f.opts.PortName,
+	// and a reader goroutine still blocked on it would race for the
+	// bootloader's ACK/NACK bytes.
+	if err := f.StopUpdating(); err != nil {
+		return fmt.Errorf("closing MSP connection: %w", err)
+	}
+	ctx := context.Background()
+	board, err := prog.Detect(ctx)
 	if err != nil {
 		return err
 	}
-	var device string
-	for _, dev := range devices {
-		if strings.Contains(dev, internalFlashMarker) {
-			device = dev
-			break
-		}
+	f.printf("Flashing %s via %s bootloader (%s)...\n", filepath.Base(binaryPath), board.MCUFamily, selectProgrammer(f.variant, f.targetName, f.opts.Programmer))
+	if err := prog.Erase(ctx, firmware.Data); err != nil {
+		return fmt.Errorf("erasing: %w", err)
 	}
-	// a device line looks like:
-	// [0483:df11] ver=2200, devnum=17, cfg=1, intf=0, path="20-1", alt=0, name="@Internal Flash  /0x08000000/04*016Kg,01*064Kg,07*128Kg", serial="3276365D3336"
-	// We need to extract alt, serial and the flash offset
-	alt := f.regexpFind("alt=(\\d+)", device)
-	serial := f.regexpFind(`serial="(.*?)"`, device)
-	offset := f.regexpFind("Internal Flash  /([\\dx]*?)/", device)
-	if alt == "" || serial == "" || offset == "" {
-		return fmt.Errorf("could not determine flash parameters from %q", device)
+	if err := prog.Write(ctx, firmware.Data, nil); err != nil {
+		return fmt.Errorf("writing: %w", err)
 	}
-	f.printf("Flashing %s via DFU to offset %s...\n", filepath.Base(binaryPath), offset)
-	cmd := exec.Command(dfuPath, "-a", alt, "-S", serial, "-s", offset+":leave", "-D", binaryPath)
-	cmd.Stdout = f.opts.Stdout
-	cmd.Stderr = f.opts.stderr()
-	return cmd.Run()
+	return prog.Leave(ctx)
+}
+
+// Reboots the board into the bootloader for flashing
+func (f *FC) rebootIntoBootloader() error {
+	_, err := f.msp.RebootIntoBootloader()
+	return err
 }
 
 func (f *FC) reset() {
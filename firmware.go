@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// manifestSuffix is appended to a firmware image's path to get its
+// manifest path, e.g. "obj/inav_MATEKF405.bin.manifest".
+const manifestSuffix = ".manifest"
+
+// FirmwareManifest describes one firmware image: what board it's for
+// and how to tell it hasn't been tampered with. It's loaded from JSON
+// next to the .bin it describes.
+type FirmwareManifest struct {
+	Target      string `json:"target"`
+	Variant     string `json:"variant"`
+	MinVersion  string `json:"minVersion,omitempty"`
+	MaxVersion  string `json:"maxVersion,omitempty"`
+	MCUFamily   string `json:"mcuFamily,omitempty"`
+	SHA256      string `json:"sha256"`
+	FlashOffset string `json:"flashOffset,omitempty"`
+	// SigningKey and Signature are both base64-encoded; SigningKey is
+	// the Ed25519 public key and Signature is over the raw image bytes.
+	// Both are optional: a manifest without them is still checked
+	// against SHA256, just not against tampering after the fact.
+	SigningKey string `json:"signingKey,omitempty"`
+	Signature  string `json:"signature,omitempty"`
+}
+
+// Firmware is a firmware image, paired with the manifest describing it
+// when one exists alongside it.
+type Firmware struct {
+	Path     string
+	Data     []byte
+	Manifest FirmwareManifest
+	// HasManifest is false when no manifest file was found next to Path.
+	// Verify and MatchesBoard are both no-ops in that case: the image
+	// can still be flashed, just without the extra checks a manifest
+	// would otherwise let us make.
+	HasManifest bool
+}
+
+// LoadFirmware reads the image at path and the manifest alongside it
+// (path+".manifest"), if there is one. A missing manifest isn't an
+// error - most binaries `make binary` produces don't have one - but a
+// malformed one is, since that indicates a manifest someone meant to
+// ship.
+func LoadFirmware(path string) (*Firmware, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifestPath := path + manifestSuffix
+	manifestData, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Firmware{Path: path, Data: data}, nil
+		}
+		return nil, err
+	}
+	var manifest FirmwareManifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest %s: %w", manifestPath, err)
+	}
+	return &Firmware{Path: path, Data: data, Manifest: manifest, HasManifest: true}, nil
+}
+
+// Verify checks the image's SHA-256 against the manifest, and its
+// Ed25519 signature too if the manifest carries a signing key. It's a
+// no-op when the image has no manifest.
+func (fw *Firmware) Verify() error {
+	if !fw.HasManifest {
+		return nil
+	}
+	sum := sha256.Sum256(fw.Data)
+	got := hex.EncodeToString(sum[:])
+	if fw.Manifest.SHA256 == "" {
+		return errors.New("manifest doesn't carry a sha256 to verify against")
+	}
+	if !strings.EqualFold(got, fw.Manifest.SHA256) {
+		return fmt.Errorf("firmware hash mismatch: manifest says %s, image is %s", fw.Manifest.SHA256, got)
+	}
+	if fw.Manifest.SigningKey == "" {
+		return nil
+	}
+	pub, err := base64.StdEncoding.DecodeString(fw.Manifest.SigningKey)
+	if err != nil {
+		return fmt.Errorf("decoding manifest signing key: %w", err)
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("manifest signing key is %d bytes, want %d", len(pub), ed25519.PublicKeySize)
+	}
+	sig, err := base64.StdEncoding.DecodeString(fw.Manifest.Signature)
+	if err != nil {
+		return fmt.Errorf("decoding manifest signature: %w", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), fw.Data, sig) {
+		return errors.New("firmware signature verification failed")
+	}
+	return nil
+}
+
+// MatchesBoard checks the manifest's target, variant and version range
+// against the fields FC populated from handleFrame, so a Betaflight
+// image can't be flashed onto an iNAV board or onto the wrong target.
+// It's a no-op when the image has no manifest.
+func (fw *Firmware) MatchesBoard(fc *FC) error {
+	if !fw.HasManifest {
+		return nil
+	}
+	if fw.Manifest.Target != "" && fc.targetName != "" && fw.Manifest.Target != fc.targetName {
+		return fmt.Errorf("firmware is built for target %s, board reports %s", fw.Manifest.Target, fc.targetName)
+	}
+	if fw.Manifest.Variant != "" && fc.variant != "" && fw.Manifest.Variant != fc.variant {
+		return fmt.Errorf("firmware is built for %s, board is running %s", fw.Manifest.Variant, fc.variant)
+	}
+	boardVersion := [3]byte{fc.versionMajor, fc.versionMinor, fc.versionPatch}
+	if fw.Manifest.MinVersion != "" {
+		min, err := parseVersion(fw.Manifest.MinVersion)
+		if err != nil {
+			return fmt.Errorf("manifest minVersion: %w", err)
+		}
+		if versionLess(boardVersion, min) {
+			return fmt.Errorf("firmware requires %s %s or later, board is running %d.%d.%d", fw.Manifest.Variant, fw.Manifest.MinVersion, boardVersion[0], boardVersion[1], boardVersion[2])
+		}
+	}
+	if fw.Manifest.MaxVersion != "" {
+		max, err := parseVersion(fw.Manifest.MaxVersion)
+		if err != nil {
+			return fmt.Errorf("manifest maxVersion: %w", err)
+		}
+		if versionLess(max, boardVersion) {
+			return fmt.Errorf("firmware supports up to %s %s, board is running %d.%d.%d", fw.Manifest.Variant, fw.Manifest.MaxVersion, boardVersion[0], boardVersion[1], boardVersion[2])
+		}
+	}
+	return nil
+}
+
+func parseVersion(s string) ([3]byte, error) {
+	var v [3]byte
+	parts := strings.SplitN(s, ".", 3)
+	if len(parts) != 3 {
+		return v, fmt.Errorf("malformed version %q, want major.minor.patch", s)
+	}
+	for ii, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 255 {
+			return v, fmt.Errorf("malformed version %q, want major.minor.patch", s)
+		}
+		v[ii] = byte(n)
+	}
+	return v, nil
+}
+
+func versionLess(a, b [3]byte) bool {
+	for ii := range a {
+		if a[ii] != b[ii] {
+			return a[ii] < b[ii]
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: msp-tool <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  status    print a board status report")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "status":
+		runStatus(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+// runStatus implements `msp-tool status`: it connects to the board,
+// collects a BoardStatusReport and prints it in the requested format.
+func runStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	port := fs.String("port", "", "serial port the board is connected to")
+	baud := fs.Int("baud", 115200, "baud rate")
+	format := fs.String("format", "text", `output format: "json" or "text"`)
+	fs.Parse(args)
+	if *port == "" {
+		fmt.Fprintln(os.Stderr, "status: -port is required")
+		os.Exit(2)
+	}
+
+	fc, err := NewFC(FCOptions{PortName: *port, BaudRate: *baud, Stdout: os.Stderr})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	go fc.StartUpdating()
+
+	out, err := RunStatusCommand(fc, *format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(out)
+}
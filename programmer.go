@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// openSerialPort opens the board's UART for the stm32flash programmer.
+// The MSP connection on the same port must be closed first.
+func openSerialPort(name string, baudRate int) (io.ReadWriteCloser, error) {
+	return serial.OpenPort(&serial.Config{Name: name, Baud: baudRate})
+}
+
+// Board is what a Programmer learns about the chip it's talking to
+// during Detect.
+type Board struct {
+	MCUFamily string
+}
+
+// Programmer drives a board's bootloader end-to-end: entering it is
+// FC's job (it knows how to ask the firmware to reboot into one), but
+// everything from here on - finding the bootloader, wiping the old
+// image, writing the new one and handing control back to the
+// application - goes through this interface. FC.Flash selects an
+// implementation based on the detected variant/targetName or
+// FCOptions.Programmer.
+type Programmer interface {
+	// Detect waits for the bootloader to respond and identifies it.
+	Detect(ctx context.Context) (Board, error)
+	// Erase wipes whatever Write is about to overwrite. firmware is the
+	// image that's about to be written, so implementations that can
+	// erase selectively (e.g. dfuProgrammer) only need to touch the
+	// pages it covers; implementations that can't just ignore it and
+	// erase the whole chip.
+	Erase(ctx context.Context, firmware []byte) error
+	// Write streams firmware to the board, reporting progress in bytes.
+	Write(ctx context.Context, firmware []byte, progress func(done, total int)) error
+	// Leave exits the bootloader so the board runs the application.
+	Leave(ctx context.Context) error
+}
+
+// programmerName identifies a Programmer implementation, as accepted by
+// FCOptions.Programmer and returned by selectProgrammer.
+type programmerName string
+
+const (
+	programmerDFU        programmerName = "dfu"
+	programmerSTM32Flash programmerName = "stm32flash"
+	programmerBossac     programmerName = "bossac"
+)
+
+// stm32flashTargets lists substrings of targetName that indicate an
+// STM32F1-based board, which has no USB bootloader and can only be
+// flashed over its UART bootloader via stm32flash.
+var stm32flashTargets = []string{"NAZE", "CC3D", "CJMCU", "SPRACINGF1"}
+
+// selectProgrammer picks a Programmer name for the given variant and
+// target, absent an explicit override. SAMD targets use bossac's SAM-BA
+// protocol; known F1-based targets have no USB bootloader and go over
+// stm32flash; everything else is assumed to be an STM32F3/F4/F7 part
+// reachable over the USB DFU bootloader, which is the common case for
+// the iNAV/Betaflight targets msp-tool has historically supported.
+func selectProgrammer(variant, targetName string, override string) programmerName {
+	if override != "" {
+		return programmerName(override)
+	}
+	upperTarget := strings.ToUpper(targetName)
+	if strings.Contains(upperTarget, "SAMD") {
+		return programmerBossac
+	}
+	for _, t := range stm32flashTargets {
+		if strings.Contains(upperTarget, t) {
+			return programmerSTM32Flash
+		}
+	}
+	return programmerDFU
+}
+
+// newProgrammer constructs the Programmer selected for this FC, talking
+// to the board over f.opts.PortName when it needs a serial port. Flash
+// calls FC.StopUpdating before handing control to the Programmer, so
+// the port is free for a serial-based one like stm32flashProgrammer to
+// reopen.
+func (f *FC) newProgrammer() (Programmer, error) {
+	switch selectProgrammer(f.variant, f.targetName, f.opts.Programmer) {
+	case programmerSTM32Flash:
+		return newSTM32FlashProgrammer(f.opts.PortName, f.opts.BaudRate, f.opts.Stdout), nil
+	case programmerBossac:
+		return newBossacProgrammer(f.opts.PortName, f.opts.Stdout)
+	default:
+		dfu, err := newDFU(f.opts.Stdout)
+		if err != nil {
+			return nil, fmt.Errorf("no DFU backend available (tried libusb and dfu-util): %w", err)
+		}
+		return newDFUProgrammer(dfu), nil
+	}
+}
+
+// dfuProgrammer implements Programmer on top of a DFU backend.
+type dfuProgrammer struct {
+	dfu DFU
+	dev DFUDevice
+}
+
+func newDFUProgrammer(dfu DFU) *dfuProgrammer {
+	return &dfuProgrammer{dfu: dfu}
+}
+
+func (p *dfuProgrammer) Detect(ctx context.Context) (Board, error) {
+	dev, err := p.dfu.WaitForDevice(30 * time.Second)
+	if err != nil {
+		return Board{}, err
+	}
+	p.dev = dev
+	return Board{MCUFamily: "stm32"}, nil
+}
+
+func (p *dfuProgrammer) Erase(ctx context.Context, firmware []byte) error {
+	return p.dfu.Erase(p.dev, firmware)
+}
+
+func (p *dfuProgrammer) Write(ctx context.Context, firmware []byte, progress func(done, total int)) error {
+	return p.dfu.Write(p.dev, firmware, progress)
+}
+
+func (p *dfuProgrammer) Leave(ctx context.Context) error {
+	return p.dfu.Leave(p.dev)
+}
+
+// stm32flash AN3155 bootloader protocol bytes.
+const (
+	stm32flashSync     = 0x7f
+	stm32flashAck      = 0x79
+	stm32flashNack     = 0x1f
+	stm32flashCmdGet   = 0x00
+	stm32flashCmdErase = 0x43
+	stm32flashCmdWrite = 0x31
+	stm32flashCmdGo    = 0x21
+
+	stm32flashPageSize = 256
+)
+
+// stm32flashProgrammer implements Programmer by speaking the ST AN3155
+// UART bootloader protocol over the same serial port the MSP session
+// was using. It's the fallback for targets without a USB bootloader.
+type stm32flashProgrammer struct {
+	portName string
+	baudRate int
+	stdout   io.Writer
+	port     io.ReadWriteCloser
+	start    uint32
+}
+
+func newSTM32FlashProgrammer(portName string, baudRate int, stdout io.Writer) *stm32flashProgrammer {
+	return &stm32flashProgrammer{portName: portName, baudRate: baudRate, stdout: stdout, start: 0x08000000}
+}
+
+func (p *stm32flashProgrammer) expectAck(b byte) error {
+	if b != stm32flashAck {
+		return fmt.Errorf("stm32flash: expected ACK, got 0x%02x", b)
+	}
+	return nil
+}
+
+func (p *stm32flashProgrammer) readByte() (byte, error) {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(p.port, buf); err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+// sendByteAndComplement writes b followed by its one's complement, as
+// required by every AN3155 command byte and by the single-byte global
+// erase parameter, and waits for the ACK.
+func (p *stm32flashProgrammer) sendByteAndComplement(b byte) error {
+	if _, err := p.port.Write([]byte{b, b ^ 0xff}); err != nil {
+		return err
+	}
+	ack, err := p.readByte()
+	if err != nil {
+		return err
+	}
+	return p.expectAck(ack)
+}
+
+// sendCommand writes a command byte followed by its complement, as
+// required by every AN3155 command, and waits for the ACK.
+func (p *stm32flashProgrammer) sendCommand(cmd byte) error {
+	return p.sendByteAndComplement(cmd)
+}
+
+// sendFramed writes data followed by an XOR checksum over every byte in
+// it, and waits for the ACK. Used for the address and payload frames of
+// WRITE MEMORY and for the address frame of GO.
+func (p *stm32flashProgrammer) sendFramed(data []byte) error {
+	checksum := byte(0)
+	for _, b := range data {
+		checksum ^= b
+	}
+	if _, err := p.port.Write(append(append([]byte{}, data...), checksum)); err != nil {
+		return err
+	}
+	b, err := p.readByte()
+	if err != nil {
+		return err
+	}
+	return p.expectAck(b)
+}
+
+func (p *stm32flashProgrammer) Detect(ctx context.Context) (Board, error) {
+	port, err := openSerialPort(p.portName, p.baudRate)
+	if err != nil {
+		return Board{}, err
+	}
+	p.port = port
+	// The bootloader is entered by sending the sync byte on its own;
+	// on success it replies with a single ACK.
+	if _, err := p.port.Write([]byte{stm32flashSync}); err != nil {
+		return Board{}, err
+	}
+	b, err := p.readByte()
+	if err != nil {
+		return Board{}, err
+	}
+	if err := p.expectAck(b); err != nil {
+		return Board{}, err
+	}
+	return Board{MCUFamily: "stm32"}, nil
+}
+
+func (p *stm32flashProgrammer) Erase(ctx context.Context, firmware []byte) error {
+	// AN3155 only exposes a whole-chip mass erase, not per-page erase,
+	// so firmware is unused: command followed by the global-erase
+	// parameter 0xff (AN3155, section 3.4). That parameter is framed
+	// like a command byte - 0xff plus its complement 0x00 - not like the
+	// multi-byte address/payload frames sendFramed checksums, so it
+	// can't be routed through sendFramed without miscomputing the
+	// trailing byte.
+	if err := p.sendCommand(stm32flashCmdErase); err != nil {
+		return err
+	}
+	return p.sendByteAndComplement(0xff)
+}
+
+func (p *stm32flashProgrammer) Write(ctx context.Context, firmware []byte, progress func(done, total int)) error {
+	total := len(firmware)
+	addr := p.start
+	for done := 0; done < total; {
+		end := done + stm32flashPageSize
+		if end > total {
+			end = total
+		}
+		chunk := firmware[done:end]
+		// AN3155 WRITE MEMORY requires the data length to be a multiple
+		// of 4; pad the last, possibly short, chunk with 0xff (the
+		// erased-flash value) rather than send a length the bootloader
+		// will NACK.
+		if len(chunk)%4 != 0 {
+			padded := make([]byte, (len(chunk)+3)&^3)
+			copy(padded, chunk)
+			for ii := len(chunk); ii < len(padded); ii++ {
+				padded[ii] = 0xff
+			}
+			chunk = padded
+		}
+
+		if err := p.sendCommand(stm32flashCmdWrite); err != nil {
+			return fmt.Errorf("WRITE MEMORY at 0x%08x: %w", addr, err)
+		}
+		addrBuf := make([]byte, 4)
+		binary.BigEndian.PutUint32(addrBuf, addr)
+		if err := p.sendFramed(addrBuf); err != nil {
+			return fmt.Errorf("sending address 0x%08x: %w", addr, err)
+		}
+		// The byte count minus one, followed by the data, checksummed
+		// together.
+		payload := append([]byte{byte(len(chunk) - 1)}, chunk...)
+		if err := p.sendFramed(payload); err != nil {
+			return fmt.Errorf("writing %d bytes at 0x%08x: %w", len(chunk), addr, err)
+		}
+
+		addr += uint32(len(chunk))
+		done = end
+		if progress != nil {
+			progress(done, total)
+		}
+	}
+	return nil
+}
+
+func (p *stm32flashProgrammer) Leave(ctx context.Context) error {
+	defer p.port.Close()
+	if err := p.sendCommand(stm32flashCmdGo); err != nil {
+		return err
+	}
+	addrBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(addrBuf, p.start)
+	return p.sendFramed(addrBuf)
+}
+
+// bossacProgrammer implements Programmer by shelling out to bossac, the
+// SAM-BA programmer used by Arduino-derived SAMD toolchains. It's the
+// fallback for boards without a native Go SAM-BA client.
+type bossacProgrammer struct {
+	path     string
+	portName string
+	stdout   io.Writer
+}
+
+func newBossacProgrammer(portName string, stdout io.Writer) (*bossacProgrammer, error) {
+	path, err := exec.LookPath("bossac")
+	if err != nil {
+		return nil, err
+	}
+	return &bossacProgrammer{path: path, portName: portName, stdout: stdout}, nil
+}
+
+func (p *bossacProgrammer) run(args ...string) error {
+	cmd := exec.Command(p.path, append([]string{"-p", p.portName}, args...)...)
+	cmd.Stdout = p.stdout
+	cmd.Stderr = p.stdout
+	return cmd.Run()
+}
+
+func (p *bossacProgrammer) Detect(ctx context.Context) (Board, error) {
+	if err := p.run("-i"); err != nil {
+		return Board{}, err
+	}
+	return Board{MCUFamily: "samd"}, nil
+}
+
+func (p *bossacProgrammer) Erase(ctx context.Context, firmware []byte) error {
+	return p.run("-e")
+}
+
+func (p *bossacProgrammer) Write(ctx context.Context, firmware []byte, progress func(done, total int)) error {
+	tmp, err := ioutil.TempFile("", "msp-tool-*.bin")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(firmware); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if err := p.run("-w", "-v", tmp.Name()); err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(len(firmware), len(firmware))
+	}
+	return nil
+}
+
+func (p *bossacProgrammer) Leave(ctx context.Context) error {
+	return p.run("-R")
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// statusExInfo is the subset of MSP_STATUS_EX we decode: timing, I2C
+// health, which sensors are detected and whether the board is armed.
+// Sensors is decoded but not included in BoardStatusReport.
+type statusExInfo struct {
+	CycleTime   uint16
+	I2CErrors   uint16
+	Sensors     uint16
+	ArmingFlags uint32
+}
+
+type motorConfigInfo struct {
+	MinThrottle uint16
+	MaxThrottle uint16
+	MinCommand  uint16
+}
+
+// pidInfo is one row of MSP_PID: the three gains for a single axis.
+type pidInfo struct {
+	P, I, D byte
+}
+
+type rxConfigInfo struct {
+	SerialRXProvider byte
+	MaxCheck         uint16
+	MidRC            uint16
+	MinCheck         uint16
+}
+
+type vtxConfigInfo struct {
+	Type    byte
+	Band    byte
+	Channel byte
+	Power   byte
+}
+
+type batteryConfigInfo struct {
+	VBatScale          byte
+	VBatMinCellVoltage byte
+	VBatMaxCellVoltage byte
+}
+
+// featureNames maps mspFeature bitmap bits to their names, in bit order.
+// Unused/unknown bits are omitted from reports rather than guessed at.
+var featureNames = map[uint32]string{
+	1 << 0:                 "RX_PPM",
+	1 << 2:                 "INFLIGHT_ACC_CAL",
+	1 << 3:                 "RX_SERIAL",
+	1 << 4:                 "MOTOR_STOP",
+	1 << 5:                 "SERVO_TILT",
+	1 << 6:                 "SOFTSERIAL",
+	1 << 7:                 "GPS",
+	1 << 9:                 "SONAR",
+	1 << 10:                "TELEMETRY",
+	1 << 12:                "3D",
+	1 << 13:                "RX_PARALLEL_PWM",
+	1 << 14:                "RX_MSP",
+	1 << 15:                "RSSI_ADC",
+	1 << 16:                "LED_STRIP",
+	1 << 17:                "DISPLAY",
+	1 << 19:                "CHANNEL_FORWARDING",
+	1 << 20:                "TRANSPONDER",
+	1 << 21:                "AIRMODE",
+	1 << 22:                "RX_SPI",
+	1 << 23:                "SOFTSPI",
+	1 << 24:                "ESC_SENSOR",
+	1 << 25:                "ANTI_GRAVITY",
+	1 << 26:                "DYNAMIC_FILTER",
+	mspFCFeatureDebugTrace: "DEBUG_TRACE",
+}
+
+func decodeFeatures(bitmap uint32) []string {
+	var names []string
+	for bit, name := range featureNames {
+		if bitmap&bit != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// serialPortStatus is the human-readable form of one MSPSerialConfig
+// entry: which functions are routed to that port.
+type serialPortStatus struct {
+	Identifier string   `json:"identifier"`
+	Functions  []string `json:"functions"`
+}
+
+// serialFunctionNames maps MSPSerialConfig.FunctionMask bits to names.
+var serialFunctionNames = map[uint16]string{
+	serialFunctionMSP:        "MSP",
+	serialFunctionDebugTrace: "DEBUG_TRACE",
+	serialFunctionGPS:        "GPS",
+	serialFunctionTelemetry:  "TELEMETRY",
+	serialFunctionRX:         "RX",
+}
+
+func decodeSerialFunctions(mask uint16) []string {
+	var names []string
+	for bit, name := range serialFunctionNames {
+		if mask&bit != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BoardStatusReport is a single, diffable snapshot of everything
+// msp-tool knows about a board: what updateInfo already collects plus
+// the extra queries BoardStatus makes. It's meant to be attached to bug
+// reports instead of pasted scrollback.
+type BoardStatusReport struct {
+	APIVersion    string             `json:"apiVersion"`
+	Variant       string             `json:"variant"`
+	Version       string             `json:"version"`
+	BoardID       string             `json:"boardId"`
+	TargetName    string             `json:"targetName,omitempty"`
+	BuildDate     string             `json:"buildDate"`
+	BuildTime     string             `json:"buildTime"`
+	BuildRev      string             `json:"buildRevision"`
+	Name          string             `json:"name,omitempty"`
+	Features      []string           `json:"features"`
+	SerialPorts   []serialPortStatus `json:"serialPorts"`
+	CycleTime     uint16             `json:"cycleTime"`
+	I2CErrors     uint16             `json:"i2cErrors"`
+	ArmingFlags   uint32             `json:"armingFlags"`
+	MotorConfig   motorConfigInfo    `json:"motorConfig"`
+	PIDs          []pidInfo          `json:"pids"`
+	RXConfig      rxConfigInfo       `json:"rxConfig"`
+	VTXConfig     vtxConfigInfo      `json:"vtxConfig"`
+	BatteryConfig batteryConfigInfo  `json:"batteryConfig"`
+	BoxNames      []string           `json:"boxNames"`
+}
+
+// JSON renders the report as indented JSON, suitable for attaching to
+// an issue.
+func (r *BoardStatusReport) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// Text renders the report as a human-readable tree.
+func (r *BoardStatusReport) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s (board %s", r.Variant, r.Version, r.BoardID)
+	if r.TargetName != "" {
+		fmt.Fprintf(&b, ", target %s", r.TargetName)
+	}
+	b.WriteString(")\n")
+	fmt.Fprintf(&b, "  API version: %s\n", r.APIVersion)
+	fmt.Fprintf(&b, "  Build: %s (%s %s)\n", r.BuildRev, r.BuildDate, r.BuildTime)
+	if r.Name != "" {
+		fmt.Fprintf(&b, "  Name: %s\n", r.Name)
+	}
+	fmt.Fprintf(&b, "  Cycle time: %dus, I2C errors: %d, arming flags: 0x%08x\n", r.CycleTime, r.I2CErrors, r.ArmingFlags)
+	fmt.Fprintf(&b, "  Features: %s\n", strings.Join(r.Features, ", "))
+	b.WriteString("  Serial ports:\n")
+	for _, p := range r.SerialPorts {
+		fmt.Fprintf(&b, "    %s: %s\n", p.Identifier, strings.Join(p.Functions, ", "))
+	}
+	fmt.Fprintf(&b, "  Motor config: min=%d max=%d command=%d\n", r.MotorConfig.MinThrottle, r.MotorConfig.MaxThrottle, r.MotorConfig.MinCommand)
+	b.WriteString("  PIDs:\n")
+	for ii, p := range r.PIDs {
+		fmt.Fprintf(&b, "    %d: P=%d I=%d D=%d\n", ii, p.P, p.I, p.D)
+	}
+	fmt.Fprintf(&b, "  RX config: provider=%d midrc=%d mincheck=%d maxcheck=%d\n",
+		r.RXConfig.SerialRXProvider, r.RXConfig.MidRC, r.RXConfig.MinCheck, r.RXConfig.MaxCheck)
+	fmt.Fprintf(&b, "  VTX config: type=%d band=%d channel=%d power=%d\n",
+		r.VTXConfig.Type, r.VTXConfig.Band, r.VTXConfig.Channel, r.VTXConfig.Power)
+	fmt.Fprintf(&b, "  Battery config: scale=%d mincell=%d maxcell=%d\n",
+		r.BatteryConfig.VBatScale, r.BatteryConfig.VBatMinCellVoltage, r.BatteryConfig.VBatMaxCellVoltage)
+	fmt.Fprintf(&b, "  Boxes: %s\n", strings.Join(r.BoxNames, ", "))
+	return b.String()
+}
+
+// statusQueries is every MSP code BoardStatus requests and waits on:
+// the queries beyond what updateInfo already requests, plus
+// mspCFSerialConfig, which it requests again.
+var statusQueries = []byte{
+	mspName,
+	mspStatusEx,
+	mspMotorConfig,
+	mspPid,
+	mspRxConfig,
+	mspVtxConfig,
+	mspBatteryConfig,
+	mspBoxNames,
+	mspBoxIDs,
+	mspOsdConfig,
+	mspCFSerialConfig,
+}
+
+// BoardStatus collects a full snapshot of the board: everything
+// updateInfo requests, plus name, status, motor/PID/RX/VTX/battery
+// config and box names. It blocks until every query has answered or
+// timeout elapses.
+//
+// The answers arrive on StartUpdating's reader goroutine, via
+// handleFrame/handleStatusFrame, so statusMu guards statusPending and
+// every field below against concurrent access from that goroutine, and
+// statusDone is what handleStatusFrame signals completion on instead of
+// BoardStatus polling the map itself.
+func (f *FC) BoardStatus(timeout time.Duration) (*BoardStatusReport, error) {
+	f.statusMu.Lock()
+	f.statusPending = make(map[byte]bool, len(statusQueries))
+	for _, code := range statusQueries {
+		f.statusPending[code] = true
+	}
+	done := make(chan struct{})
+	f.statusDone = done
+	f.statusMu.Unlock()
+
+	for _, code := range statusQueries {
+		f.msp.WriteCmd(code)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		f.statusMu.Lock()
+		missing := len(f.statusPending)
+		f.statusDone = nil
+		f.statusMu.Unlock()
+		return nil, fmt.Errorf("timed out waiting for board status (still missing %d queries)", missing)
+	}
+
+	f.statusMu.Lock()
+	defer f.statusMu.Unlock()
+
+	var ports []serialPortStatus
+	for _, cfg := range f.serialConfigs {
+		ports = append(ports, serialPortStatus{
+			Identifier: fmt.Sprintf("%v", cfg.Identifier),
+			Functions:  decodeSerialFunctions(cfg.FunctionMask),
+		})
+	}
+
+	return &BoardStatusReport{
+		APIVersion:    fmt.Sprintf("%d.%d (protocol %d)", f.apiVersionMajor, f.apiVersionMinor, f.protocolVersion),
+		Variant:       f.variant,
+		Version:       fmt.Sprintf("%d.%d.%d", f.versionMajor, f.versionMinor, f.versionPatch),
+		BoardID:       f.boardID,
+		TargetName:    f.targetName,
+		BuildDate:     f.buildDate,
+		BuildTime:     f.buildTime,
+		BuildRev:      f.buildRev,
+		Name:          f.name,
+		Features:      decodeFeatures(f.features),
+		SerialPorts:   ports,
+		CycleTime:     f.statusEx.CycleTime,
+		I2CErrors:     f.statusEx.I2CErrors,
+		ArmingFlags:   f.statusEx.ArmingFlags,
+		MotorConfig:   f.motorConfig,
+		PIDs:          f.pids,
+		RXConfig:      f.rxConfig,
+		VTXConfig:     f.vtxConfig,
+		BatteryConfig: f.batteryConfig,
+		BoxNames:      f.boxNames,
+	}, nil
+}
+
+// RunStatusCommand implements the `msp-tool status --format=json|text`
+// subcommand: it collects a BoardStatusReport and renders it in the
+// requested format. format must be "json" or "text".
+func RunStatusCommand(f *FC, format string) (string, error) {
+	report, err := f.BoardStatus(5 * time.Second)
+	if err != nil {
+		return "", err
+	}
+	switch format {
+	case "json":
+		b, err := report.JSON()
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	case "text", "":
+		return report.Text(), nil
+	default:
+		return "", fmt.Errorf("unknown status format %q, want \"json\" or \"text\"", format)
+	}
+}
+
+// markStatusReceived records that code has been answered, and signals
+// BoardStatus's statusDone channel once nothing is left outstanding.
+// It's also called directly for queries decoded outside handleStatusFrame
+// (mspCFSerialConfig, handled in handleFrame since updateInfo uses it too).
+func (f *FC) markStatusReceived(code byte) {
+	f.statusMu.Lock()
+	defer f.statusMu.Unlock()
+	if f.statusPending == nil {
+		return
+	}
+	delete(f.statusPending, code)
+	if len(f.statusPending) == 0 && f.statusDone != nil {
+		close(f.statusDone)
+		f.statusDone = nil
+	}
+}
+
+// handleStatusFrame decodes the extra MSP frames BoardStatus requested
+// and marks them as received.
+func (f *FC) handleStatusFrame(fr *MSPFrame) {
+	defer f.markStatusReceived(fr.Code)
+	f.statusMu.Lock()
+	defer f.statusMu.Unlock()
+	switch fr.Code {
+	case mspName:
+		f.name = strings.TrimRight(string(fr.Payload), "\x00")
+	case mspStatusEx:
+		if len(fr.Payload) >= 10 {
+			fr.Read(&f.statusEx.CycleTime)
+			fr.Read(&f.statusEx.I2CErrors)
+			fr.Read(&f.statusEx.Sensors)
+			fr.Read(&f.statusEx.ArmingFlags)
+		}
+	case mspMotorConfig:
+		if len(fr.Payload) >= 6 {
+			fr.Read(&f.motorConfig.MinThrottle)
+			fr.Read(&f.motorConfig.MaxThrottle)
+			fr.Read(&f.motorConfig.MinCommand)
+		}
+	case mspPid:
+		f.pids = f.pids[:0]
+		for ii := 0; ii+2 < len(fr.Payload); ii += 3 {
+			f.pids = append(f.pids, pidInfo{P: fr.Payload[ii], I: fr.Payload[ii+1], D: fr.Payload[ii+2]})
+		}
+	case mspRxConfig:
+		if len(fr.Payload) >= 7 {
+			fr.Read(&f.rxConfig.SerialRXProvider)
+			fr.Read(&f.rxConfig.MaxCheck)
+			fr.Read(&f.rxConfig.MidRC)
+			fr.Read(&f.rxConfig.MinCheck)
+		}
+	case mspVtxConfig:
+		if len(fr.Payload) >= 4 {
+			fr.Read(&f.vtxConfig.Type)
+			fr.Read(&f.vtxConfig.Band)
+			fr.Read(&f.vtxConfig.Channel)
+			fr.Read(&f.vtxConfig.Power)
+		}
+	case mspBatteryConfig:
+		if len(fr.Payload) >= 3 {
+			fr.Read(&f.batteryConfig.VBatScale)
+			fr.Read(&f.batteryConfig.VBatMinCellVoltage)
+			fr.Read(&f.batteryConfig.VBatMaxCellVoltage)
+		}
+	case mspBoxNames:
+		f.boxNames = nil
+		for _, name := range strings.Split(string(fr.Payload), ";") {
+			if name != "" {
+				f.boxNames = append(f.boxNames, name)
+			}
+		}
+	case mspBoxIDs:
+		f.boxIDs = append([]byte(nil), fr.Payload...)
+	case mspOsdConfig:
+		f.osdConfig = append([]byte(nil), fr.Payload...)
+	}
+}